@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/palantir/stacktrace"
+)
+
+// AzureStorage is the Storage backend for azblob:// locations. bucket/key
+// pairs map onto container/blob names, with dots in the container name
+// replaced as required by Azure (see azureSafeContainer).
+type AzureStorage struct {
+	client *azblob.Client
+}
+
+func NewAzureStorage(ctx context.Context, accountURL string) (*AzureStorage, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't prepare Azure credentials - try running `az login`")
+	}
+
+	client, err := azblob.NewClient(accountURL, credential, nil)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Azure client")
+	}
+
+	return &AzureStorage{client: client}, nil
+}
+
+func (s *AzureStorage) Get(ctx context.Context, bucket, key string) (io.ReadCloser, Metadata, error) {
+	container := azureSafeContainer(bucket)
+	out, err := s.client.DownloadStream(ctx, container, key, nil)
+	if err != nil {
+		return nil, Metadata{}, stacktrace.Propagate(err, "%s/%s download failed", container, key)
+	}
+	meta := Metadata{}
+	if out.ContentLength != nil {
+		meta.Size = *out.ContentLength
+	}
+	if out.ETag != nil {
+		meta.ETag = string(*out.ETag)
+	}
+	if out.ContentMD5 != nil {
+		meta.ContentMD5 = out.ContentMD5
+	}
+	// The download response carries no access tier; read it from the blob's
+	// properties so --tier-map can translate it.
+	props, err := s.Head(ctx, bucket, key)
+	if err != nil {
+		out.Body.Close()
+		return nil, Metadata{}, err
+	}
+	meta.AccessTier = props.AccessTier
+	return out.Body, meta, nil
+}
+
+func (s *AzureStorage) Head(ctx context.Context, bucket, key string) (Metadata, error) {
+	container := azureSafeContainer(bucket)
+	blobClient := s.client.ServiceClient().NewContainerClient(container).NewBlobClient(key)
+	props, err := blobClient.GetProperties(ctx, nil)
+	if err != nil {
+		return Metadata{}, stacktrace.Propagate(err, "%s/%s head failed", container, key)
+	}
+	meta := Metadata{}
+	if props.ContentLength != nil {
+		meta.Size = *props.ContentLength
+	}
+	if props.ETag != nil {
+		meta.ETag = string(*props.ETag)
+	}
+	if props.ContentMD5 != nil {
+		meta.ContentMD5 = props.ContentMD5
+	}
+	if props.AccessTier != nil {
+		meta.AccessTier = *props.AccessTier
+	}
+	return meta, nil
+}
+
+// Put stages r as a sequence of --block-size blocks, up to
+// --per-file-concurrency of them in flight at once via a bounded buffer
+// pool, then commits the block list. When meta doesn't already carry a
+// ContentMD5 (e.g. a multipart S3 source, whose ETag isn't a content hash),
+// Put hashes r itself as it streams the blocks, so BlobContentMD5 can still
+// be set on CommitBlockList once every block has been staged.
+func (s *AzureStorage) Put(ctx context.Context, bucket, key string, r io.Reader, meta Metadata) error {
+	container := azureSafeContainer(bucket)
+	blockClient := s.client.ServiceClient().NewContainerClient(container).NewBlockBlobClient(key)
+
+	var hasher hash.Hash
+	if len(meta.ContentMD5) == 0 {
+		hasher = md5.New()
+		r = io.TeeReader(r, hasher)
+	}
+
+	bufPool := sync.Pool{New: func() interface{} { return make([]byte, *blockSize) }}
+	sem := make(chan struct{}, *perFileConcurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var blockIDs []string
+	var stageErr error
+
+	for blockNum := 0; ; blockNum++ {
+		buf := bufPool.Get().([]byte)
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", blockNum)))
+			blockIDs = append(blockIDs, blockID)
+
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(blockID string, data []byte) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				defer bufPool.Put(data[:cap(data)])
+				_, err := blockClient.StageBlock(ctx, blockID, streaming.NopCloser(bytes.NewReader(data)), nil)
+				if err != nil {
+					mu.Lock()
+					if stageErr == nil {
+						stageErr = err
+					}
+					mu.Unlock()
+				}
+			}(blockID, buf[:n])
+		} else {
+			bufPool.Put(buf)
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			wg.Wait()
+			return stacktrace.Propagate(readErr, "reading %s/%s for upload", container, key)
+		}
+	}
+
+	wg.Wait()
+	if stageErr != nil {
+		return azureUploadErr(stageErr, container, key)
+	}
+
+	// meta.AccessTier already reflects --azure-tier/--tier-map precedence, as
+	// resolved by Copier.write's call to desiredTier.
+	var tier *blob.AccessTier
+	if meta.AccessTier != "" {
+		t := blob.AccessTier(meta.AccessTier)
+		tier = &t
+	}
+	contentMD5 := meta.ContentMD5
+	if hasher != nil {
+		contentMD5 = hasher.Sum(nil)
+	}
+	var httpHeaders *blob.HTTPHeaders
+	if len(contentMD5) > 0 {
+		httpHeaders = &blob.HTTPHeaders{BlobContentMD5: contentMD5}
+	}
+
+	_, err := blockClient.CommitBlockList(ctx, blockIDs, &blockblob.CommitBlockListOptions{
+		Tier:        tier,
+		HTTPHeaders: httpHeaders,
+	})
+	return azureUploadErr(err, container, key)
+}
+
+func azureUploadErr(err error, container, key string) error {
+	if err == nil {
+		return nil
+	}
+	if responseError, ok := stacktrace.RootCause(err).(*azcore.ResponseError); ok {
+		return stacktrace.Propagate(responseError, "%s/%s upload failed: %s", container, key, responseError.ErrorCode)
+	}
+	return stacktrace.Propagate(err, "Uploading %s/%s failed", container, key)
+}
+
+func (s *AzureStorage) List(ctx context.Context, bucket, prefix string) (<-chan string, <-chan error) {
+	keys := make(chan string)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(keys)
+		defer close(errs)
+
+		container := azureSafeContainer(bucket)
+		pager := s.client.NewListBlobsFlatPager(container, &azblob.ListBlobsFlatOptions{Prefix: &prefix})
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				errs <- stacktrace.Propagate(err, "listing %s/%s", container, prefix)
+				return
+			}
+			for _, item := range page.Segment.BlobItems {
+				if item.Name != nil {
+					keys <- *item.Name
+				}
+			}
+		}
+	}()
+
+	return keys, errs
+}
+
+func (s *AzureStorage) IsNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	var respErr *azcore.ResponseError
+	if errors.As(stacktrace.RootCause(err), &respErr) {
+		return respErr.ErrorCode == string(bloberror.BlobNotFound)
+	}
+	return bloberror.HasCode(err, bloberror.BlobNotFound)
+}
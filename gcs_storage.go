@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/palantir/stacktrace"
+	"google.golang.org/api/iterator"
+)
+
+// GCSStorage is the Storage backend for gs:// locations.
+type GCSStorage struct {
+	client *storage.Client
+}
+
+func NewGCSStorage(ctx context.Context) (*GCSStorage, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "GCS client")
+	}
+	return &GCSStorage{client: client}, nil
+}
+
+func (s *GCSStorage) Get(ctx context.Context, bucket, key string) (io.ReadCloser, Metadata, error) {
+	obj := s.client.Bucket(bucket).Object(key)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, Metadata{}, stacktrace.Propagate(err, "%s/%s head failed", bucket, key)
+	}
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, Metadata{}, stacktrace.Propagate(err, "%s/%s download failed", bucket, key)
+	}
+	return r, Metadata{Size: attrs.Size, ContentMD5: attrs.MD5, ETag: attrs.Etag, AccessTier: attrs.StorageClass}, nil
+}
+
+func (s *GCSStorage) Head(ctx context.Context, bucket, key string) (Metadata, error) {
+	attrs, err := s.client.Bucket(bucket).Object(key).Attrs(ctx)
+	if err != nil {
+		return Metadata{}, stacktrace.Propagate(err, "%s/%s head failed", bucket, key)
+	}
+	return Metadata{Size: attrs.Size, ContentMD5: attrs.MD5, ETag: attrs.Etag, AccessTier: attrs.StorageClass}, nil
+}
+
+func (s *GCSStorage) Put(ctx context.Context, bucket, key string, r io.Reader, meta Metadata) error {
+	obj := s.client.Bucket(bucket).Object(key)
+	w := obj.NewWriter(ctx)
+	if len(meta.ContentMD5) > 0 {
+		w.MD5 = meta.ContentMD5
+	}
+	if meta.AccessTier != "" {
+		w.StorageClass = meta.AccessTier
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return stacktrace.Propagate(err, "%s/%s upload failed", bucket, key)
+	}
+	if err := w.Close(); err != nil {
+		return stacktrace.Propagate(err, "%s/%s upload failed", bucket, key)
+	}
+	return nil
+}
+
+func (s *GCSStorage) List(ctx context.Context, bucket, prefix string) (<-chan string, <-chan error) {
+	keys := make(chan string)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(keys)
+		defer close(errs)
+
+		it := s.client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return
+			}
+			if err != nil {
+				errs <- stacktrace.Propagate(err, "listing %s/%s", bucket, prefix)
+				return
+			}
+			keys <- attrs.Name
+		}
+	}()
+
+	return keys, errs
+}
+
+func (s *GCSStorage) IsNotExist(err error) bool {
+	return errors.Is(stacktrace.RootCause(err), storage.ErrObjectNotExist)
+}
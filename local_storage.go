@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// LocalStorage is the Storage backend for file:// locations. Objects live
+// under root/bucket/key, so a bucket behaves like a subdirectory the same
+// way it names a container on Azure or a bucket on S3/GCS.
+type LocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+func (s *LocalStorage) path(bucket, key string) string {
+	return filepath.Join(s.root, bucket, key)
+}
+
+func (s *LocalStorage) Get(ctx context.Context, bucket, key string) (io.ReadCloser, Metadata, error) {
+	path := s.path(bucket, key)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, Metadata{}, stacktrace.Propagate(err, "%s download failed", path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Metadata{}, stacktrace.Propagate(err, "%s stat failed", path)
+	}
+	return f, Metadata{Size: info.Size()}, nil
+}
+
+func (s *LocalStorage) Head(ctx context.Context, bucket, key string) (Metadata, error) {
+	path := s.path(bucket, key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return Metadata{}, stacktrace.Propagate(err, "%s head failed", path)
+	}
+	return Metadata{Size: info.Size()}, nil
+}
+
+func (s *LocalStorage) Put(ctx context.Context, bucket, key string, r io.Reader, meta Metadata) error {
+	path := s.path(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return stacktrace.Propagate(err, "%s mkdir failed", path)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return stacktrace.Propagate(err, "%s create failed", path)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return stacktrace.Propagate(err, "%s write failed", path)
+	}
+	return nil
+}
+
+// List walks the whole bucket and keeps keys that string-prefix-match
+// prefix, the same way the S3/Azure/GCS backends' native Prefix filters
+// behave, rather than treating prefix as a path to descend into.
+func (s *LocalStorage) List(ctx context.Context, bucket, prefix string) (<-chan string, <-chan error) {
+	keys := make(chan string)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(keys)
+		defer close(errs)
+
+		bucketRoot := filepath.Join(s.root, bucket)
+		err := filepath.Walk(bucketRoot, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(bucketRoot, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if strings.HasPrefix(rel, prefix) {
+				keys <- rel
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			errs <- stacktrace.Propagate(err, "listing %s", bucketRoot)
+		}
+	}()
+
+	return keys, errs
+}
+
+func (s *LocalStorage) IsNotExist(err error) bool {
+	return os.IsNotExist(stacktrace.RootCause(err))
+}
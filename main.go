@@ -1,23 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
 	"encoding/csv"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/palantir/stacktrace"
 )
 
@@ -53,9 +54,26 @@ func (s *AzureTier) Get() *blob.AccessTier {
 }
 
 var inputFileName = flag.String("input", "-", "Input file to read. Use - for stdin.")
-var azureUrl = flag.String("azure-url", "", "https://<storage-account-name>.blob.core.windows.net/")
+var azureUrl = flag.String("azure-url", "", "https://<storage-account-name>.blob.core.windows.net/ (shorthand for --dest=azblob://<storage-account-name>.blob.core.windows.net/)")
+var sourceURL = flag.String("source", "", "Source location: s3://, azblob://<account>.blob.core.windows.net/, gs://, or file:///root. Defaults to s3://.")
+var destURL = flag.String("dest", "", "Destination location: azblob://<account>.blob.core.windows.net/, s3://, gs://, or file:///root.")
+var direction = flag.String("direction", "", "s3-to-azure or azure-to-s3: shorthand that fills in --source/--dest (with --azure-url) for the common two-way case.")
+var tierMapFlag = flag.String("tier-map", "", "Comma-separated SOURCE_TIER=DEST_CLASS pairs translating the source's storage tier/class into the destination's, e.g. Cool=STANDARD_IA,Archive=GLACIER")
 var azureTier = &AzureTier{}
-var concurrency = flag.Int("j", 1, "Number of concurrent transfers.")
+var readParallelism = flag.Int("read-parallelism", 4, "Number of concurrent downloads from the source.")
+var writeParallelism = flag.Int("write-parallelism", 4, "Number of concurrent uploads to the destination.")
+var blockSize = flag.Int64("block-size", 8*1024*1024, "Block size in bytes for chunked uploads.")
+var perFileConcurrency = flag.Int("per-file-concurrency", 4, "Number of blocks to upload concurrently for a single large file.")
+var stateFileName = flag.String("state-file", "", "Checkpoint file to append completed work items to (jsonl). Enables resuming after Ctrl-C or a crash.")
+var force = flag.Bool("force", false, "With --state-file, re-copy work items even if the state file says they already completed.")
+var resumeOnly = flag.Bool("resume-only", false, "With --state-file, don't copy anything: print the work items from --input that are missing or incomplete in the state file, as TSV, and exit.")
+var compactStateFile = flag.Bool("compact-state-file", false, "Rewrite --state-file keeping only the latest record per bucket/key, then exit.")
+var ifMissing = flag.Bool("if-missing", false, "Skip a work item when the destination already exists with matching size and content hash.")
+var verifyFlag = flag.Bool("verify", false, "After uploading, read back the destination's properties and fail the item if size/MD5 don't match the source.")
+var dryRun = flag.Bool("dry-run", false, "Classify each work item (would-copy, would-skip-exists, would-skip-tier-mismatch, would-fail-missing-source) without transferring anything.")
+var enumerate = flag.Bool("enumerate", false, "Enumerate --bucket/--prefix from --source via Storage.List instead of reading work items from --input.")
+var enumerateBucket = flag.String("bucket", "", "Bucket/container to enumerate with --enumerate.")
+var enumeratePrefix = flag.String("prefix", "", "Key prefix to enumerate with --enumerate.")
 
 var errCloseSentinel = errors.New("finished")
 
@@ -74,77 +92,368 @@ type CopyWorkItem struct {
 	Key    string
 }
 
-type FromS3Copier struct {
-	s3Client *s3.Client
-	azClient *azblob.Client
-	ctx      context.Context
+// fetchedItem is a work item whose source body has been opened and is
+// ready to be handed to the destination, decoupling --read-parallelism from
+// --write-parallelism. body is tee'd through hasher so write can report the
+// source MD5 and, with --verify, reconcile it against the destination.
+type fetchedItem struct {
+	wi      *CopyWorkItem
+	key     string
+	rawBody io.ReadCloser
+	body    io.Reader
+	meta    Metadata
+	hasher  hash.Hash
 }
 
-func (c *FromS3Copier) CopyFile(wi *CopyWorkItem) error {
+// CopyResult is one line of the per-item TSV results printed to stdout, so a
+// run's output can be piped into a follow-up run.
+type CopyResult struct {
+	Status string // copied, skipped-exists, or failed; under --dry-run, one of classify's would-* statuses
+	Bucket string
+	Key    string
+	Bytes  int64
+	MD5    string
+	Dest   string // classify's resolved destination identifier, e.g. an Azure container name; blank outside --dry-run
+}
+
+func (r CopyResult) Print() {
+	fmt.Printf("%s\t%s\t%s\t%d\t%s\t%s\n", r.Status, r.Bucket, r.Key, r.Bytes, r.MD5, r.Dest)
+}
+
+// destIdentifier reports the name dest will actually store bucket under,
+// surfacing azureSafeContainer's dot-to-dash container-name mapping when
+// dest is Azure, so --dry-run can show it before a real run commits to it.
+func destIdentifier(dest Storage, bucket string) string {
+	if _, ok := dest.(*AzureStorage); ok {
+		return azureSafeContainer(bucket)
+	}
+	return bucket
+}
+
+// matchingHash reports whether a and b look like the same object: equal
+// ContentMD5 if both backends reported one, falling back to equal ETags.
+func matchingHash(a, b Metadata) bool {
+	if len(a.ContentMD5) > 0 && len(b.ContentMD5) > 0 {
+		return bytes.Equal(a.ContentMD5, b.ContentMD5)
+	}
+	return a.ETag != "" && a.ETag == b.ETag
+}
+
+// Copier moves work items from a source Storage to a destination Storage,
+// without either side knowing which cloud it is. Reads and writes run as two
+// independently sized pools of goroutines connected by a channel, rather
+// than one pool doing both per item, so a slow destination doesn't stall
+// downloads and vice versa.
+type Copier struct {
+	source  Storage
+	dest    Storage
+	ctx     context.Context
+	state   *StateStore
+	tierMap map[string]string // --tier-map: source AccessTier/StorageClass -> destination's
+}
+
+// desiredTier reports the AccessTier write should set on the destination for
+// an object whose source AccessTier is sourceAccessTier: an explicit
+// --azure-tier always wins, otherwise only a --tier-map translation is
+// forwarded, since an untranslated tier string is another cloud's vocabulary.
+func (c *Copier) desiredTier(sourceAccessTier string) string {
+	if tier := azureTier.Get(); tier != nil {
+		return string(*tier)
+	}
+	if mapped, ok := c.tierMap[sourceAccessTier]; ok {
+		return mapped
+	}
+	return ""
+}
+
+// fetch opens the source object, unless --if-missing finds a destination
+// object that already matches it, in which case it reports a
+// skipped-exists result instead of opening anything.
+func (c *Copier) fetch(wi *CopyWorkItem) (*fetchedItem, *CopyResult, error) {
 	key, err := url.QueryUnescape(wi.Key)
 	if err != nil {
-		return stacktrace.Propagate(err, "unable to url decode %s/%s", wi.Bucket, wi.Key)
+		return nil, nil, stacktrace.Propagate(err, "unable to url decode %s/%s", wi.Bucket, wi.Key)
 	}
-	out, err := c.s3Client.GetObject(c.ctx, &s3.GetObjectInput{
-		Bucket: &wi.Bucket,
-		Key:    &key,
-	})
-	if err != nil {
-		return stacktrace.Propagate(err, "%s\t%s download failed", wi.Bucket, key)
+
+	if *ifMissing {
+		destMeta, err := c.dest.Head(c.ctx, wi.Bucket, key)
+		if err == nil {
+			sourceMeta, err := c.source.Head(c.ctx, wi.Bucket, key)
+			if err != nil {
+				return nil, nil, err
+			}
+			if sourceMeta.Size == destMeta.Size && matchingHash(sourceMeta, destMeta) {
+				return nil, &CopyResult{
+					Status: "skipped-exists",
+					Bucket: wi.Bucket,
+					Key:    key,
+					Bytes:  destMeta.Size,
+					MD5:    hex.EncodeToString(destMeta.ContentMD5),
+				}, nil
+			}
+		} else if !c.dest.IsNotExist(err) {
+			return nil, nil, err
+		}
 	}
-	defer out.Body.Close()
 
-	azureContainer := strings.ReplaceAll(wi.Bucket, ".", "-")
-	_, err = c.azClient.UploadStream(c.ctx, azureContainer, key, out.Body, &azblob.UploadStreamOptions{AccessTier: azureTier.Get()})
+	body, meta, err := c.source.Get(c.ctx, wi.Bucket, key)
 	if err != nil {
-		if responseError, ok := stacktrace.RootCause(err).(*azcore.ResponseError); ok {
-			return fmt.Errorf("%s\t%s upload failed: %s", azureContainer, key, responseError.ErrorCode)
+		return nil, nil, err
+	}
+
+	hasher := md5.New()
+	return &fetchedItem{wi: wi, key: key, rawBody: body, body: io.TeeReader(body, hasher), meta: meta, hasher: hasher}, nil, nil
+}
+
+// write uploads item to the destination and, with --verify, reads its
+// properties back to confirm size and MD5 match what was actually written.
+func (c *Copier) write(item *fetchedItem) (CopyResult, error) {
+	defer item.rawBody.Close()
+
+	result := CopyResult{Status: "copied", Bucket: item.wi.Bucket, Key: item.key, Bytes: item.meta.Size}
+
+	putMeta := item.meta
+	putMeta.AccessTier = c.desiredTier(item.meta.AccessTier)
+
+	if err := c.dest.Put(c.ctx, item.wi.Bucket, item.key, item.body, putMeta); err != nil {
+		result.Status = "failed"
+		return result, err
+	}
+	sourceMD5 := item.hasher.Sum(nil)
+	result.MD5 = hex.EncodeToString(sourceMD5)
+
+	if *verifyFlag {
+		destMeta, err := c.dest.Head(c.ctx, item.wi.Bucket, item.key)
+		if err != nil {
+			result.Status = "failed"
+			return result, stacktrace.Propagate(err, "verifying %s/%s", item.wi.Bucket, item.key)
+		}
+		if destMeta.Size != item.meta.Size || (len(destMeta.ContentMD5) > 0 && !bytes.Equal(destMeta.ContentMD5, sourceMD5)) {
+			result.Status = "failed"
+			return result, stacktrace.NewError("verify mismatch for %s/%s: size %d/%d md5 %x/%x",
+				item.wi.Bucket, item.key, item.meta.Size, destMeta.Size, sourceMD5, destMeta.ContentMD5)
 		}
-		return stacktrace.Propagate(err, "Uploading %s/%s failed", azureContainer, key)
 	}
 
-	log.Printf("Copied\t%s\t%s\n", wi.Bucket, key)
-	return nil
+	if c.state != nil {
+		if err := c.state.Record(StateRecord{
+			Bucket:      item.wi.Bucket,
+			Key:         item.key,
+			Size:        item.meta.Size,
+			ETag:        item.meta.ETag,
+			CompletedAt: time.Now().UTC(),
+		}); err != nil {
+			result.Status = "failed"
+			return result, err
+		}
+	}
+
+	log.Printf("Copied\t%s\t%s\n", item.wi.Bucket, item.key)
+	return result, nil
 }
 
-func NewS3Copier() (*FromS3Copier, error) {
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+// classify reports what a real run would do with wi, using only HEAD calls
+// (or their backend equivalent) so --dry-run never downloads or uploads
+// anything. It mirrors fetch: without --if-missing, a real run always
+// overwrites the destination, so classify reports would-copy unconditionally
+// once the source exists. The destination is considered a tier mismatch when
+// write would send it to a tier (see desiredTier) other than the one it's
+// already in.
+func (c *Copier) classify(wi *CopyWorkItem) (CopyResult, error) {
+	key, err := url.QueryUnescape(wi.Key)
 	if err != nil {
-		return nil, stacktrace.Propagate(err, "Couldn't prepare Azure credentials - try running `az login`")
+		return CopyResult{}, stacktrace.Propagate(err, "unable to url decode %s/%s", wi.Bucket, wi.Key)
 	}
 
-	azClient, err := azblob.NewClient(*azureUrl, credential, nil)
+	dest := destIdentifier(c.dest, wi.Bucket)
+
+	sourceMeta, err := c.source.Head(c.ctx, wi.Bucket, key)
 	if err != nil {
-		return nil, stacktrace.Propagate(err, "Azure client")
+		if c.source.IsNotExist(err) {
+			return CopyResult{Status: "would-fail-missing-source", Bucket: wi.Bucket, Key: key, Dest: dest}, nil
+		}
+		return CopyResult{}, err
 	}
+	result := CopyResult{Bucket: wi.Bucket, Key: key, Bytes: sourceMeta.Size, Dest: dest}
 
-	cfg, err := config.LoadDefaultConfig(context.Background())
+	if !*ifMissing {
+		result.Status = "would-copy"
+		return result, nil
+	}
+
+	destMeta, err := c.dest.Head(c.ctx, wi.Bucket, key)
 	if err != nil {
-		log.Fatal(err)
+		if c.dest.IsNotExist(err) {
+			result.Status = "would-copy"
+			return result, nil
+		}
+		return CopyResult{}, err
 	}
-	s3Client := s3.NewFromConfig(cfg)
 
-	c := FromS3Copier{
-		azClient: azClient,
-		s3Client: s3Client,
-		ctx:      context.Background(),
+	if destMeta.Size == sourceMeta.Size && matchingHash(sourceMeta, destMeta) {
+		if tier := c.desiredTier(sourceMeta.AccessTier); tier != "" && destMeta.AccessTier != tier {
+			result.Status = "would-skip-tier-mismatch"
+		} else {
+			result.Status = "would-skip-exists"
+		}
+		return result, nil
 	}
-	return &c, nil
+
+	result.Status = "would-copy"
+	return result, nil
 }
 
-func (c *FromS3Copier) DoCopy(inputs chan *CopyWorkItem, resultsChannel chan error) {
-	for workItem := range inputs {
-		if c.ctx.Err() != nil {
-			break
+// runDryRun classifies every work item from inputs and prints the result,
+// without calling source.Get or dest.Put.
+func runDryRun(c *Copier, inputs <-chan *CopyWorkItem) {
+	for wi := range inputs {
+		result, err := c.classify(wi)
+		if err != nil {
+			log.Printf("Error: %s", err)
+			continue
 		}
-		err := c.CopyFile(workItem)
-		resultsChannel <- err
+		result.Print()
 	}
-	resultsChannel <- errCloseSentinel
 }
 
-func readerLoop() chan *CopyWorkItem {
-	output := make(chan *CopyWorkItem)
+// runFetchers runs n concurrent readers pulling work items from inputs,
+// pushing successfully opened ones to fetched and reporting fetch errors
+// (and --if-missing skips) directly to results. It closes fetched once
+// inputs is drained.
+func (c *Copier) runFetchers(n int, inputs <-chan *CopyWorkItem, fetched chan<- *fetchedItem, results chan<- error) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for wi := range inputs {
+				if c.ctx.Err() != nil {
+					break
+				}
+				item, skipped, err := c.fetch(wi)
+				if err != nil {
+					results <- err
+					continue
+				}
+				if skipped != nil {
+					skipped.Print()
+					results <- nil
+					continue
+				}
+				fetched <- item
+			}
+		}()
+	}
+	wg.Wait()
+	close(fetched)
+}
+
+// runWriters runs n concurrent writers draining fetched and reporting each
+// item's outcome on results, followed by a single errCloseSentinel once
+// fetched is closed and every writer has drained.
+func (c *Copier) runWriters(n int, fetched <-chan *fetchedItem, results chan<- error) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range fetched {
+				result, err := c.write(item)
+				result.Print()
+				results <- err
+			}
+		}()
+	}
+	wg.Wait()
+	results <- errCloseSentinel
+}
+
+// resolveSourceDest applies --direction's defaults on top of --source/--dest.
+// --direction is shorthand for the common two-way case: plain s3:// or
+// azblob://<--azure-url> on whichever side wasn't given explicitly.
+func resolveSourceDest() (source, dest string, err error) {
+	source, dest = *sourceURL, *destURL
+	// --azure-url is an https:// endpoint; the azblob:// form takes only its host and path.
+	azureDest := "azblob://" + strings.TrimPrefix(strings.TrimPrefix(*azureUrl, "https://"), "http://")
+
+	switch *direction {
+	case "":
+		// no shorthand; fall through to the defaults below
+	case "s3-to-azure":
+		if source == "" {
+			source = "s3://"
+		}
+		if dest == "" && *azureUrl != "" {
+			dest = azureDest
+		}
+	case "azure-to-s3":
+		if source == "" {
+			if *azureUrl == "" {
+				return "", "", stacktrace.NewError("--direction=azure-to-s3 requires --source or --azure-url")
+			}
+			source = azureDest
+		}
+		if dest == "" {
+			dest = "s3://"
+		}
+	default:
+		return "", "", stacktrace.NewError("unknown --direction %q (want s3-to-azure or azure-to-s3)", *direction)
+	}
+
+	if source == "" {
+		source = "s3://"
+	}
+	if dest == "" {
+		if *azureUrl == "" {
+			return "", "", stacktrace.NewError("either --dest, --direction, or --azure-url must be set")
+		}
+		dest = azureDest
+	}
+	return source, dest, nil
+}
+
+// parseTierMap parses --tier-map's SOURCE_TIER=DEST_CLASS,... syntax.
+func parseTierMap(s string) (map[string]string, error) {
+	tierMap := map[string]string{}
+	if s == "" {
+		return tierMap, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, stacktrace.NewError("malformed --tier-map entry %q (want SOURCE_TIER=DEST_CLASS)", pair)
+		}
+		tierMap[k] = v
+	}
+	return tierMap, nil
+}
+
+// NewCopier resolves --source/--dest/--direction into a Copier.
+func NewCopier(ctx context.Context, state *StateStore) (*Copier, error) {
+	source, dest, err := resolveSourceDest()
+	if err != nil {
+		return nil, err
+	}
+
+	sourceStorage, err := NewStorage(ctx, source)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "resolving --source")
+	}
+	destStorage, err := NewStorage(ctx, dest)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "resolving --dest")
+	}
+
+	tierMap, err := parseTierMap(*tierMapFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Copier{source: sourceStorage, dest: destStorage, ctx: ctx, state: state, tierMap: tierMap}, nil
+}
+
+// openInput opens --input (or stdin) and returns a tab-separated reader over it.
+func openInput() (*csv.Reader, io.Closer) {
 	var inputFile io.Reader
 	var inputFileCloser io.Closer = nil
 	if *inputFileName == "-" {
@@ -157,6 +466,14 @@ func readerLoop() chan *CopyWorkItem {
 	}
 	workReader := csv.NewReader(inputFile)
 	workReader.Comma = '\t'
+	return workReader, inputFileCloser
+}
+
+// readerLoop streams work items from --input. If state is non-nil and
+// --force wasn't passed, items already recorded as completed are skipped.
+func readerLoop(state *StateStore) chan *CopyWorkItem {
+	output := make(chan *CopyWorkItem)
+	workReader, inputFileCloser := openInput()
 
 	go func() {
 		defer close(output)
@@ -178,6 +495,16 @@ func readerLoop() chan *CopyWorkItem {
 				log.Fatalf("Wrong number of fields at line %d: %d fields", i, len(line))
 			}
 
+			if state != nil && !*force {
+				key, err := url.QueryUnescape(line[1])
+				if err != nil {
+					log.Fatalf("Error url decoding key at line %d: %s", i, err)
+				}
+				if state.IsCompleted(line[0], key) {
+					continue
+				}
+			}
+
 			output <- &CopyWorkItem{Bucket: line[0], Key: line[1]}
 		}
 	}()
@@ -185,21 +512,130 @@ func readerLoop() chan *CopyWorkItem {
 	return output
 }
 
+// enumerateLoop streams work items from bucket/prefix via source.List for
+// --enumerate, instead of requiring a pre-built --input TSV. Keys are
+// url-escaped the same way --input lines are, so fetch/classify's
+// url.QueryUnescape sees what it expects. If state is non-nil and --force
+// wasn't passed, items already recorded as completed are skipped, the same
+// as readerLoop.
+func enumerateLoop(ctx context.Context, source Storage, bucket, prefix string, state *StateStore) chan *CopyWorkItem {
+	output := make(chan *CopyWorkItem)
+	keys, errs := source.List(ctx, bucket, prefix)
+
+	go func() {
+		defer close(output)
+		for key := range keys {
+			if state != nil && !*force && state.IsCompleted(bucket, key) {
+				continue
+			}
+			output <- &CopyWorkItem{Bucket: bucket, Key: url.QueryEscape(key)}
+		}
+		if err := <-errs; err != nil {
+			log.Fatalf("Error enumerating %s/%s: %s", bucket, prefix, err)
+		}
+	}()
+
+	return output
+}
+
+// workItems returns the channel of work items to process: an --enumerate
+// listing of c.source, or --input/--state-file's resumable TSV otherwise.
+func workItems(c *Copier, state *StateStore) chan *CopyWorkItem {
+	if *enumerate {
+		return enumerateLoop(c.ctx, c.source, *enumerateBucket, *enumeratePrefix, state)
+	}
+	return readerLoop(state)
+}
+
+// printResumeWork prints, as TSV, the --input work items that are missing
+// or incomplete in the state file, without performing any copies. It's meant
+// to be piped into a later `azure_loader --input -` run.
+func printResumeWork(state *StateStore) {
+	workReader, inputFileCloser := openInput()
+	if inputFileCloser != nil {
+		defer inputFileCloser.Close()
+	}
+
+	for i := 1; true; i++ {
+		line, err := workReader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			log.Fatalf("Error reading input at line %d: %s", i, err)
+		}
+		if len(line) != 2 {
+			log.Fatalf("Wrong number of fields at line %d: %d fields", i, len(line))
+		}
+		key, err := url.QueryUnescape(line[1])
+		if err != nil {
+			log.Fatalf("Error url decoding key at line %d: %s", i, err)
+		}
+		if !state.IsCompleted(line[0], key) {
+			fmt.Printf("%s\t%s\n", line[0], line[1])
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
 
-	inputs := readerLoop()
-	results := make(chan error, 2*(*concurrency))
+	if *readParallelism <= 0 {
+		log.Fatalf("--read-parallelism must be positive, got %d", *readParallelism)
+	}
+	if *writeParallelism <= 0 {
+		log.Fatalf("--write-parallelism must be positive, got %d", *writeParallelism)
+	}
+	if *blockSize <= 0 {
+		log.Fatalf("--block-size must be positive, got %d", *blockSize)
+	}
+	if *perFileConcurrency <= 0 {
+		log.Fatalf("--per-file-concurrency must be positive, got %d", *perFileConcurrency)
+	}
+	if *enumerate && *enumerateBucket == "" {
+		log.Fatal("--enumerate requires --bucket")
+	}
+
+	if *compactStateFile {
+		if *stateFileName == "" {
+			log.Fatal("--compact-state-file requires --state-file")
+		}
+		handleError(CompactStateFile(*stateFileName))
+		return
+	}
 
-	workers := make([]*FromS3Copier, 0, *concurrency)
-	for i := len(workers); i < *concurrency; i++ {
-		c, err := NewS3Copier()
+	var state *StateStore
+	if *stateFileName != "" {
+		s, err := OpenStateStore(*stateFileName)
 		handleError(err)
-		workers = append(workers, c)
-		go c.DoCopy(inputs, results)
+		state = s
+		defer state.Close()
 	}
 
-	expectedCloses := *concurrency
+	if *resumeOnly {
+		if state == nil {
+			log.Fatal("--resume-only requires --state-file")
+		}
+		printResumeWork(state)
+		return
+	}
+
+	c, err := NewCopier(context.Background(), state)
+	handleError(err)
+
+	if *dryRun {
+		runDryRun(c, workItems(c, state))
+		return
+	}
+
+	inputs := workItems(c, state)
+	fetched := make(chan *fetchedItem, *writeParallelism)
+	results := make(chan error, *readParallelism+*writeParallelism)
+
+	go c.runFetchers(*readParallelism, inputs, fetched, results)
+	go c.runWriters(*writeParallelism, fetched, results)
+
+	expectedCloses := 1
 	seenOk := 0
 	seen := 0
 	for res := range results {
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/palantir/stacktrace"
+)
+
+// s3MultipartThreshold is S3's hard ceiling for a single PutObject; anything
+// larger has to go through CreateMultipartUpload/UploadPart/CompleteMultipartUpload.
+const s3MultipartThreshold = 5 * 1024 * 1024 * 1024
+
+// md5FromETag extracts an object's MD5 from its S3 ETag, which is the quoted
+// hex MD5 for a single-part upload but not a content hash at all once a
+// multipart upload's "-N" part-count suffix is present.
+func md5FromETag(etag string) []byte {
+	etag = strings.Trim(etag, `"`)
+	if strings.Contains(etag, "-") {
+		return nil
+	}
+	sum, err := hex.DecodeString(etag)
+	if err != nil {
+		return nil
+	}
+	return sum
+}
+
+// S3Storage is the Storage backend for s3:// locations.
+type S3Storage struct {
+	client *s3.Client
+}
+
+func NewS3Storage(ctx context.Context) (*S3Storage, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "loading AWS config")
+	}
+	return &S3Storage{client: s3.NewFromConfig(cfg)}, nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, bucket, key string) (io.ReadCloser, Metadata, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return nil, Metadata{}, stacktrace.Propagate(err, "%s/%s download failed", bucket, key)
+	}
+	meta := Metadata{}
+	if out.ContentLength != nil {
+		meta.Size = *out.ContentLength
+	}
+	if out.ETag != nil {
+		meta.ETag = *out.ETag
+		meta.ContentMD5 = md5FromETag(*out.ETag)
+	}
+	meta.AccessTier = string(out.StorageClass)
+	return out.Body, meta, nil
+}
+
+func (s *S3Storage) Head(ctx context.Context, bucket, key string) (Metadata, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return Metadata{}, stacktrace.Propagate(err, "%s/%s head failed", bucket, key)
+	}
+	meta := Metadata{}
+	if out.ContentLength != nil {
+		meta.Size = *out.ContentLength
+	}
+	if out.ETag != nil {
+		meta.ETag = *out.ETag
+		meta.ContentMD5 = md5FromETag(*out.ETag)
+	}
+	meta.AccessTier = string(out.StorageClass)
+	return meta, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, bucket, key string, r io.Reader, meta Metadata) error {
+	if meta.Size > s3MultipartThreshold {
+		return s.putMultipart(ctx, bucket, key, r, meta)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   r,
+	}
+	if len(meta.ContentMD5) > 0 {
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(meta.ContentMD5))
+	}
+	if meta.AccessTier != "" {
+		input.StorageClass = types.StorageClass(meta.AccessTier)
+	}
+	_, err := s.client.PutObject(ctx, input)
+	if err != nil {
+		return stacktrace.Propagate(err, "%s/%s upload failed", bucket, key)
+	}
+	return nil
+}
+
+// putMultipart uploads r as a sequence of --block-size parts, up to
+// --per-file-concurrency of them in flight at once, the way AzureStorage.Put
+// stages blocks.
+func (s *S3Storage) putMultipart(ctx context.Context, bucket, key string, r io.Reader, meta Metadata) error {
+	var storageClass types.StorageClass
+	if meta.AccessTier != "" {
+		storageClass = types.StorageClass(meta.AccessTier)
+	}
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       &bucket,
+		Key:          &key,
+		StorageClass: storageClass,
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "%s/%s multipart create failed", bucket, key)
+	}
+	uploadID := created.UploadId
+
+	abort := func() {
+		_, _ = s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: &bucket, Key: &key, UploadId: uploadID})
+	}
+
+	bufPool := sync.Pool{New: func() interface{} { return make([]byte, *blockSize) }}
+	sem := make(chan struct{}, *perFileConcurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var parts []types.CompletedPart
+	var uploadErr error
+
+	for partNum := int32(1); ; partNum++ {
+		buf := bufPool.Get().([]byte)
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(partNum int32, data []byte) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				defer bufPool.Put(data[:cap(data)])
+				out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+					Bucket:     &bucket,
+					Key:        &key,
+					UploadId:   uploadID,
+					PartNumber: &partNum,
+					Body:       bytes.NewReader(data),
+				})
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					if uploadErr == nil {
+						uploadErr = err
+					}
+					return
+				}
+				parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: &partNum})
+			}(partNum, buf[:n])
+		} else {
+			bufPool.Put(buf)
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			wg.Wait()
+			abort()
+			return stacktrace.Propagate(readErr, "reading %s/%s for upload", bucket, key)
+		}
+	}
+
+	wg.Wait()
+	if uploadErr != nil {
+		abort()
+		return stacktrace.Propagate(uploadErr, "%s/%s multipart part upload failed", bucket, key)
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &bucket,
+		Key:             &key,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		abort()
+		return stacktrace.Propagate(err, "%s/%s multipart complete failed", bucket, key)
+	}
+	return nil
+}
+
+func (s *S3Storage) List(ctx context.Context, bucket, prefix string) (<-chan string, <-chan error) {
+	keys := make(chan string)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(keys)
+		defer close(errs)
+
+		paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+			Bucket: &bucket,
+			Prefix: &prefix,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				errs <- stacktrace.Propagate(err, "listing %s/%s", bucket, prefix)
+				return
+			}
+			for _, obj := range page.Contents {
+				if obj.Key != nil {
+					keys <- *obj.Key
+				}
+			}
+		}
+	}()
+
+	return keys, errs
+}
+
+func (s *S3Storage) IsNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := stacktrace.RootCause(err)
+	var notFound *types.NoSuchKey
+	if errors.As(cause, &notFound) {
+		return true
+	}
+	var respErr *smithyhttp.ResponseError
+	if errors.As(cause, &respErr) {
+		return respErr.HTTPStatusCode() == 404
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// StateRecord is one line of the state/checkpoint file: a completed work
+// item, so a later run can tell it apart from one that still needs a copy.
+type StateRecord struct {
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ETag        string    `json:"etag"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+func stateKey(bucket, key string) string {
+	return bucket + "\x00" + key
+}
+
+// stateFlushEvery batches fsyncs instead of syncing after every single
+// record, since a big migration can complete thousands of items a second.
+const stateFlushEvery = 50
+
+// StateStore is an append-only checkpoint log: on open it loads whichever
+// records are already there so readerLoop can skip completed work items,
+// and as new items complete it appends to the same file.
+type StateStore struct {
+	mu        sync.Mutex
+	file      *os.File
+	completed map[string]StateRecord
+	pending   int
+}
+
+// OpenStateStore opens (creating if necessary) the state file at path,
+// replaying any records already in it.
+func OpenStateStore(path string) (*StateStore, error) {
+	completed := map[string]StateRecord{}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var rec StateRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				f.Close()
+				return nil, stacktrace.Propagate(err, "parsing state file %s", path)
+			}
+			completed[stateKey(rec.Bucket, rec.Key)] = rec
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "reading state file %s", path)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, stacktrace.Propagate(err, "opening state file %s", path)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "opening state file %s for append", path)
+	}
+
+	return &StateStore{file: file, completed: completed}, nil
+}
+
+// IsCompleted reports whether bucket/key already has a record in the state
+// file, i.e. a previous run already copied it.
+func (s *StateStore) IsCompleted(bucket, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.completed[stateKey(bucket, key)]
+	return ok
+}
+
+// Record appends a completed work item to the state file, fsyncing every
+// stateFlushEvery records rather than on each call.
+func (s *StateStore) Record(rec StateRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return stacktrace.Propagate(err, "marshaling state record for %s/%s", rec.Bucket, rec.Key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return stacktrace.Propagate(err, "writing state record for %s/%s", rec.Bucket, rec.Key)
+	}
+	s.completed[stateKey(rec.Bucket, rec.Key)] = rec
+
+	s.pending++
+	if s.pending >= stateFlushEvery {
+		s.pending = 0
+		if err := s.file.Sync(); err != nil {
+			return stacktrace.Propagate(err, "syncing state file")
+		}
+	}
+	return nil
+}
+
+// Close flushes any unsynced records and closes the underlying file.
+func (s *StateStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return stacktrace.Propagate(err, "syncing state file")
+	}
+	return s.file.Close()
+}
+
+// CompactStateFile rewrites the state file at path keeping only the latest
+// record per (bucket, key), so a long-running migration's checkpoint log
+// doesn't grow without bound across retried items.
+func CompactStateFile(path string) error {
+	store, err := OpenStateStore(path)
+	if err != nil {
+		return err
+	}
+	store.file.Close()
+
+	tmpPath := path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return stacktrace.Propagate(err, "creating %s", tmpPath)
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, rec := range store.completed {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			tmp.Close()
+			return stacktrace.Propagate(err, "marshaling state record for %s/%s", rec.Bucket, rec.Key)
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			tmp.Close()
+			return stacktrace.Propagate(err, "writing %s", tmpPath)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return stacktrace.Propagate(err, "flushing %s", tmpPath)
+	}
+	if err := tmp.Close(); err != nil {
+		return stacktrace.Propagate(err, "closing %s", tmpPath)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return stacktrace.Propagate(err, "replacing %s with compacted state", path)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStateStoreRoundTrip writes N records, reopens the store to confirm
+// IsCompleted survives a restart, then compacts and confirms it still does -
+// the property a multi-hour migration's --state-file/--resume-only/--force
+// handling depends on not regressing silently.
+func TestStateStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+
+	store, err := OpenStateStore(path)
+	if err != nil {
+		t.Fatalf("OpenStateStore: %s", err)
+	}
+
+	records := []StateRecord{
+		{Bucket: "bucket-a", Key: "one.txt", Size: 1, ETag: "etag-1", CompletedAt: time.Unix(0, 0).UTC()},
+		{Bucket: "bucket-a", Key: "two.txt", Size: 2, ETag: "etag-2", CompletedAt: time.Unix(0, 0).UTC()},
+		{Bucket: "bucket-b", Key: "one.txt", Size: 3, ETag: "etag-3", CompletedAt: time.Unix(0, 0).UTC()},
+	}
+	for _, rec := range records {
+		if err := store.Record(rec); err != nil {
+			t.Fatalf("Record(%s/%s): %s", rec.Bucket, rec.Key, err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	reopened, err := OpenStateStore(path)
+	if err != nil {
+		t.Fatalf("reopening: %s", err)
+	}
+	for _, rec := range records {
+		if !reopened.IsCompleted(rec.Bucket, rec.Key) {
+			t.Errorf("IsCompleted(%s/%s) = false after reopen, want true", rec.Bucket, rec.Key)
+		}
+	}
+	if reopened.IsCompleted("bucket-a", "missing.txt") {
+		t.Errorf("IsCompleted(bucket-a/missing.txt) = true, want false")
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if err := CompactStateFile(path); err != nil {
+		t.Fatalf("CompactStateFile: %s", err)
+	}
+
+	compacted, err := OpenStateStore(path)
+	if err != nil {
+		t.Fatalf("opening compacted state: %s", err)
+	}
+	defer compacted.Close()
+	for _, rec := range records {
+		if !compacted.IsCompleted(rec.Bucket, rec.Key) {
+			t.Errorf("IsCompleted(%s/%s) = false after compaction, want true", rec.Bucket, rec.Key)
+		}
+	}
+}